@@ -0,0 +1,212 @@
+/*
+MIT License
+
+Copyright (c) 2022 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TrzszConfig holds the parsed contents of ~/.trzsz.conf, with defaults filled
+// in for any keys that are absent. A TrzszConfig is never mutated once built;
+// a reload builds a brand new one and swaps it in with GetConfig's atomic.Value,
+// so readers always see a fully-populated, consistent snapshot.
+type TrzszConfig struct {
+	DefaultDownloadPath   string
+	DefaultUploadPath     string
+	ProgressColorMode     string
+	OverwritePolicy       string
+	AllowedUploadRoots    []string
+	MaxTransferBytes      int64
+	RedactTransferPayload bool
+}
+
+func defaultTrzszConfig() *TrzszConfig {
+	return &TrzszConfig{
+		ProgressColorMode: "auto",
+		OverwritePolicy:   "ask",
+	}
+}
+
+var gConfig atomic.Value // holds *TrzszConfig
+
+func init() {
+	gConfig.Store(defaultTrzszConfig())
+}
+
+// GetConfig returns the currently active configuration. It never blocks on
+// file I/O and is safe to call from any goroutine.
+func GetConfig() *TrzszConfig {
+	return gConfig.Load().(*TrzszConfig)
+}
+
+func trzszConfigPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".trzsz.conf"), nil
+}
+
+func parseTrzszConfigFile(path string) (*TrzszConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := defaultTrzszConfig()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[0:idx])
+		value := strings.TrimSpace(line[idx+1:])
+		if len(value) == 0 {
+			continue
+		}
+		switch key {
+		case "DefaultDownloadPath":
+			config.DefaultDownloadPath = value
+		case "DefaultUploadPath":
+			config.DefaultUploadPath = value
+		case "ProgressColorMode":
+			config.ProgressColorMode = value
+		case "OverwritePolicy":
+			config.OverwritePolicy = value
+		case "AllowedUploadRoots":
+			config.AllowedUploadRoots = strings.Split(value, ",")
+		case "MaxTransferBytes":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid MaxTransferBytes %q: %v", value, err)
+			}
+			config.MaxTransferBytes = n
+		case "RedactTransferPayload":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RedactTransferPayload %q: %v", value, err)
+			}
+			config.RedactTransferPayload = b
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// initConfig loads ~/.trzsz.conf once at startup, then starts a background
+// watcher that hot-reloads it whenever the file changes so the wrapped shell
+// never has to be restarted to pick up new settings. Missing config files are
+// not an error; the defaults from defaultTrzszConfig stay in effect.
+func initConfig() {
+	path, err := trzszConfigPath()
+	if err != nil {
+		return
+	}
+	if config, err := parseTrzszConfigFile(path); err == nil {
+		gConfig.Store(config)
+	}
+	go watchConfigFile(path)
+}
+
+func reloadConfig(path string) {
+	config, err := parseTrzszConfigFile(path)
+	if err != nil {
+		traceLogf("config reload of %s failed, keeping previous config: %v", path, err)
+		return
+	}
+	gConfig.Store(config)
+	traceLogf("config reloaded from %s", path)
+}
+
+// watchConfigFile watches path for changes using fsnotify, falling back to a
+// 5 second stat-based poller on platforms where inotify/kqueue is unavailable
+// or the watch could not be established.
+func watchConfigFile(path string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		pollConfigFile(path)
+		return
+	}
+	defer watcher.Close()
+
+	// Watch the containing directory rather than the file itself so the
+	// watch survives editors that save by rename-and-replace.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		pollConfigFile(path)
+		return
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != path {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				reloadConfig(path)
+			}
+		case _, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+func pollConfigFile(path string) {
+	var lastModTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModTime = info.ModTime()
+	}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(lastModTime) {
+			lastModTime = info.ModTime()
+			reloadConfig(path)
+		}
+	}
+}
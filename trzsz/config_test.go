@@ -0,0 +1,119 @@
+/*
+MIT License
+
+Copyright (c) 2022 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTempConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ".trzsz.conf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write temp config: %v", err)
+	}
+	return path
+}
+
+func TestParseTrzszConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    *TrzszConfig
+		wantErr bool
+	}{
+		{
+			name:    "empty file keeps defaults",
+			content: "",
+			want:    defaultTrzszConfig(),
+		},
+		{
+			name: "sets known keys and windows-style paths survive",
+			content: "DefaultDownloadPath = /home/alice/downloads\n" +
+				"DefaultUploadPath=C:\\Users\\Alice\\Uploads\n" +
+				"ProgressColorMode = dark\n" +
+				"OverwritePolicy=overwrite\n" +
+				"AllowedUploadRoots = C:\\Users\\Alice,/home/alice\n" +
+				"MaxTransferBytes = 1048576\n" +
+				"RedactTransferPayload = true\n",
+			want: &TrzszConfig{
+				DefaultDownloadPath:   "/home/alice/downloads",
+				DefaultUploadPath:     "C:\\Users\\Alice\\Uploads",
+				ProgressColorMode:     "dark",
+				OverwritePolicy:       "overwrite",
+				AllowedUploadRoots:    []string{"C:\\Users\\Alice", "/home/alice"},
+				MaxTransferBytes:      1048576,
+				RedactTransferPayload: true,
+			},
+		},
+		{
+			name:    "blank values are ignored",
+			content: "DefaultDownloadPath=\n",
+			want:    defaultTrzszConfig(),
+		},
+		{
+			name:    "unknown keys are ignored",
+			content: "SomeFutureKey=whatever\n",
+			want:    defaultTrzszConfig(),
+		},
+		{
+			name:    "invalid MaxTransferBytes is an error",
+			content: "MaxTransferBytes=not-a-number\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid RedactTransferPayload is an error",
+			content: "RedactTransferPayload=maybe\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTempConfig(t, tt.content)
+			got, err := parseTrzszConfigFile(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got config %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseTrzszConfigFile() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrzszConfigFileMissing(t *testing.T) {
+	if _, err := parseTrzszConfigFile(filepath.Join(t.TempDir(), "does-not-exist")); err == nil {
+		t.Fatal("expected an error for a missing config file")
+	}
+}
@@ -0,0 +1,246 @@
+/*
+MIT License
+
+Copyright (c) 2022 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const defaultTraceLogMaxSize = 16 * 1024 * 1024
+const traceLogMaxBackups = 3
+
+// gTraceLoggerPtr is the active trace logger, or nil if tracing is off.
+// wrapInput and wrapOutput run in separate goroutines and both read it, while
+// enabling/disabling tracing (also on wrapOutput's goroutine, but triggered
+// asynchronously from shell output) swaps it and handleTrzsz (its own
+// goroutine) and addDragFiles dereference it, so the pointer itself is stored
+// and loaded atomically rather than through a bare package variable.
+var gTraceLoggerPtr unsafe.Pointer // *traceLogger
+
+func loadTraceLogger() *traceLogger {
+	return (*traceLogger)(atomic.LoadPointer(&gTraceLoggerPtr))
+}
+
+func storeTraceLogger(l *traceLogger) {
+	atomic.StorePointer(&gTraceLoggerPtr, unsafe.Pointer(l))
+}
+
+// traceLogEvent is one line of the trace log's JSONL format.
+type traceLogEvent struct {
+	Ts    int64  `json:"ts"`
+	Dir   string `json:"dir,omitempty"`
+	Phase string `json:"phase,omitempty"`
+	Seq   uint64 `json:"seq"`
+	Len   int    `json:"len,omitempty"`
+	Data  string `json:"data,omitempty"`
+}
+
+// traceLogger writes one JSON object per line describing trzsz activity. It
+// rotates the file once it grows past maxSize, keeping the last
+// traceLogMaxBackups rotated files around via rename-and-reopen. wrapInput
+// and wrapOutput run concurrently for the life of a session and both log
+// through the same traceLogger, so all state is guarded by mu.
+type traceLogger struct {
+	mu      sync.Mutex
+	file    *os.File
+	path    string
+	size    int64
+	maxSize int64
+	seq     uint64
+
+	bytesIn          int64
+	bytesOut         int64
+	transfersStarted int64
+	filesDragged     int64
+}
+
+func newTraceLogger() (*traceLogger, error) {
+	file, err := os.CreateTemp("", "trzsz_*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	return &traceLogger{file: file, path: file.Name(), maxSize: defaultTraceLogMaxSize}, nil
+}
+
+func (l *traceLogger) Name() string {
+	return l.path
+}
+
+func (l *traceLogger) Close() {
+	l.file.Close()
+}
+
+// write must be called with l.mu held.
+func (l *traceLogger) write(event *traceLogEvent) {
+	event.Seq = l.seq
+	l.seq++
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if l.size+int64(len(line)) > l.maxSize {
+		l.rotate()
+	}
+	n, err := l.file.Write(line)
+	if err == nil {
+		l.size += int64(n)
+	}
+	l.file.Sync()
+}
+
+// rotate closes the current file, shifts any existing backups up by one
+// (dropping the oldest past traceLogMaxBackups), and reopens path fresh.
+func (l *traceLogger) rotate() {
+	l.file.Close()
+	for i := traceLogMaxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	os.Rename(l.path, l.path+".1")
+	if file, err := os.Create(l.path); err == nil {
+		l.file = file
+		l.size = 0
+	}
+}
+
+// logData records a chunk of shell or transfer I/O. When redact is true the
+// payload is replaced with its length and SHA-256 so file contents being
+// transferred never reach the trace log.
+func (l *traceLogger) logData(dir, phase string, buf []byte, redact bool) {
+	event := &traceLogEvent{Ts: time.Now().UnixMilli(), Dir: dir, Phase: phase, Len: len(buf)}
+	if redact {
+		sum := sha256.Sum256(buf)
+		event.Data = fmt.Sprintf("sha256:%s", hex.EncodeToString(sum[:]))
+	} else {
+		event.Data = encodeBytes(buf)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if dir == "in" {
+		l.bytesIn += int64(len(buf))
+	} else {
+		l.bytesOut += int64(len(buf))
+	}
+	l.write(event)
+}
+
+// logEvent records a non-I/O event, such as a config reload or a transfer
+// starting.
+func (l *traceLogger) logEvent(phase, data string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.write(&traceLogEvent{Ts: time.Now().UnixMilli(), Phase: phase, Data: data})
+}
+
+func (l *traceLogger) logState() {
+	l.mu.Lock()
+	state := fmt.Sprintf(
+		"bytesIn=%d bytesOut=%d transfersStarted=%d filesDragged=%d",
+		l.bytesIn, l.bytesOut, l.transfersStarted, l.filesDragged)
+	l.write(&traceLogEvent{Ts: time.Now().UnixMilli(), Phase: "state", Data: state})
+	l.mu.Unlock()
+}
+
+// addTransferStarted atomically increments the transfersStarted counter
+// reported by logState.
+func (l *traceLogger) addTransferStarted() {
+	l.mu.Lock()
+	l.transfersStarted++
+	l.mu.Unlock()
+}
+
+// addFilesDragged atomically adds n to the filesDragged counter reported by
+// logState.
+func (l *traceLogger) addFilesDragged(n int64) {
+	l.mu.Lock()
+	l.filesDragged += n
+	l.mu.Unlock()
+}
+
+// traceLogf appends a JSON log event to the active trace log, if any. It is
+// a no-op otherwise, so callers don't need to check for a logger first.
+func traceLogf(format string, args ...interface{}) {
+	logger := loadTraceLogger()
+	if logger == nil {
+		return
+	}
+	logger.logEvent("log", fmt.Sprintf(format, args...))
+}
+
+// writeTraceLog feeds buf through the active trace logger, handling the
+// <ENABLE_TRZSZ_TRACE_LOG>, <DISABLE_TRZSZ_TRACE_LOG>, and
+// <DUMP_TRZSZ_TRACE_STATE> sentinels embedded in shell output. inTransfer
+// reports whether a file transfer is currently in progress, which both
+// labels the event's phase and decides whether RedactTransferPayload applies.
+func writeTraceLog(buf []byte, output, inTransfer bool) []byte {
+	// Windows disable log: echo ^<DISABLE_TRZSZ_TRACE_LOG^>
+	// Linux macOS disable log: echo -e '\x3CDISABLE_TRZSZ_TRACE_LOG\x3E'
+	if logger := loadTraceLogger(); logger != nil {
+		if output && bytes.Contains(buf, []byte("<DUMP_TRZSZ_TRACE_STATE>")) {
+			logger.logState()
+			msg := fmt.Sprintf("Dumped trace state to %s", logger.Name())
+			return bytes.ReplaceAll(buf, []byte("<DUMP_TRZSZ_TRACE_STATE>"), []byte(msg))
+		}
+		if output && bytes.Contains(buf, []byte("<DISABLE_TRZSZ_TRACE_LOG>")) {
+			msg := fmt.Sprintf("Closed trace log at %s", logger.Name())
+			storeTraceLogger(nil)
+			logger.Close()
+			return bytes.ReplaceAll(buf, []byte("<DISABLE_TRZSZ_TRACE_LOG>"), []byte(msg))
+		}
+		dir := "in"
+		phase := "shell"
+		if output {
+			dir = "out"
+		}
+		if inTransfer {
+			phase = "transfer"
+		}
+		logger.logData(dir, phase, buf, inTransfer && GetConfig().RedactTransferPayload)
+		return buf
+	}
+	// Windows enable log: echo ^<ENABLE_TRZSZ_TRACE_LOG^>
+	// Linux macOS enable log: echo -e '\x3CENABLE_TRZSZ_TRACE_LOG\x3E'
+	if output && bytes.Contains(buf, []byte("<ENABLE_TRZSZ_TRACE_LOG>")) {
+		var msg string
+		logger, err := newTraceLogger()
+		if err != nil {
+			msg = fmt.Sprintf("Create log file error: %v", err)
+		} else {
+			storeTraceLogger(logger)
+			msg = fmt.Sprintf("Writing trace log to %s", logger.Name())
+		}
+		return bytes.ReplaceAll(buf, []byte("<ENABLE_TRZSZ_TRACE_LOG>"), []byte(msg))
+	}
+	return buf
+}
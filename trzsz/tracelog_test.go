@@ -0,0 +1,204 @@
+/*
+MIT License
+
+Copyright (c) 2022 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestTraceLogger(t *testing.T, maxSize int64) *traceLogger {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create trace log file: %v", err)
+	}
+	return &traceLogger{file: file, path: path, maxSize: maxSize}
+}
+
+func readEvents(t *testing.T, path string) []traceLogEvent {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	var events []traceLogEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event traceLogEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("failed to unmarshal line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestTraceLoggerLogDataRedaction(t *testing.T) {
+	l := newTestTraceLogger(t, defaultTraceLogMaxSize)
+	defer l.Close()
+
+	payload := []byte("top secret file contents")
+	l.logData("in", "transfer", payload, true)
+	l.logData("out", "shell", []byte("hello"), false)
+
+	events := readEvents(t, l.path)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+
+	sum := sha256.Sum256(payload)
+	wantRedacted := fmt.Sprintf("sha256:%s", hex.EncodeToString(sum[:]))
+	if events[0].Data != wantRedacted {
+		t.Errorf("redacted Data = %q, want %q", events[0].Data, wantRedacted)
+	}
+	if events[0].Len != len(payload) {
+		t.Errorf("redacted Len = %d, want %d", events[0].Len, len(payload))
+	}
+
+	if events[1].Data == wantRedacted || strings.HasPrefix(events[1].Data, "sha256:") {
+		t.Errorf("unredacted Data unexpectedly looks like a digest: %q", events[1].Data)
+	}
+}
+
+func TestTraceLoggerRotation(t *testing.T) {
+	// Force a rotation on every single small event so we can assert the
+	// backup file was created.
+	l := newTestTraceLogger(t, 1)
+	defer l.Close()
+
+	l.logEvent("test", "first")
+	l.logEvent("test", "second")
+
+	if _, err := os.Stat(l.path + ".1"); err != nil {
+		t.Fatalf("expected rotated backup %s.1 to exist: %v", l.path, err)
+	}
+	events := readEvents(t, l.path)
+	if len(events) != 1 || events[0].Data != "second" {
+		t.Fatalf("active log after rotation = %+v, want a single event for \"second\"", events)
+	}
+	backup := readEvents(t, l.path+".1")
+	if len(backup) != 1 || backup[0].Data != "first" {
+		t.Fatalf("backup log = %+v, want a single event for \"first\"", backup)
+	}
+}
+
+func TestTraceLoggerRotationKeepsOnlyLastBackups(t *testing.T) {
+	l := newTestTraceLogger(t, 1)
+	defer l.Close()
+
+	for i := 0; i < traceLogMaxBackups+2; i++ {
+		l.logEvent("test", fmt.Sprintf("event-%d", i))
+	}
+
+	if _, err := os.Stat(fmt.Sprintf("%s.%d", l.path, traceLogMaxBackups)); err != nil {
+		t.Errorf("expected backup .%d to exist: %v", traceLogMaxBackups, err)
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.%d", l.path, traceLogMaxBackups+1)); err == nil {
+		t.Errorf("did not expect backup .%d to exist", traceLogMaxBackups+1)
+	}
+}
+
+func TestTraceLoggerConcurrentWritesDontRace(t *testing.T) {
+	l := newTestTraceLogger(t, 4096)
+	defer l.Close()
+
+	const goroutines = 8
+	const perGoroutine = 50
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				l.logData("in", "shell", []byte("x"), false)
+				l.addTransferStarted()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.transfersStarted != goroutines*perGoroutine {
+		t.Errorf("transfersStarted = %d, want %d", l.transfersStarted, goroutines*perGoroutine)
+	}
+	if l.seq != goroutines*perGoroutine {
+		t.Errorf("seq = %d, want %d", l.seq, goroutines*perGoroutine)
+	}
+}
+
+// TestGlobalTraceLoggerConcurrentToggle exercises the package-level
+// gTraceLoggerPtr the way wrapInput, wrapOutput, handleTrzsz, and
+// addDragFiles do: one goroutine enables/disables tracing (the
+// <ENABLE_TRZSZ_TRACE_LOG>/<DISABLE_TRZSZ_TRACE_LOG> sentinel path) while
+// others do the bare "load, then use if non-nil" pattern from a separate
+// goroutine. Before gTraceLoggerPtr was made atomic this could observe a
+// non-nil logger in the check and a nil one on the very next line, panicking
+// with a nil-pointer dereference; run with -race to also catch a data race
+// on the pointer itself.
+func TestGlobalTraceLoggerConcurrentToggle(t *testing.T) {
+	previous := loadTraceLogger()
+	defer storeTraceLogger(previous)
+
+	logger := newTestTraceLogger(t, defaultTraceLogMaxSize)
+	defer logger.Close()
+
+	const iterations = 500
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			storeTraceLogger(logger)
+			storeTraceLogger(nil)
+		}
+	}()
+
+	const readers = 8
+	wg.Add(readers)
+	for r := 0; r < readers; r++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				if l := loadTraceLogger(); l != nil {
+					l.addTransferStarted()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,82 @@
+/*
+MIT License
+
+Copyright (c) 2022 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// withAllowedUploadRoots temporarily installs a config with the given
+// AllowedUploadRoots and restores the previous config on cleanup.
+func withAllowedUploadRoots(t *testing.T, roots []string) {
+	t.Helper()
+	previous := GetConfig()
+	config := defaultTrzszConfig()
+	config.AllowedUploadRoots = roots
+	gConfig.Store(config)
+	t.Cleanup(func() { gConfig.Store(previous) })
+}
+
+func TestCheckUploadRootsAllowed(t *testing.T) {
+	dir := t.TempDir()
+	inside := filepath.Join(dir, "file.txt")
+	outside := filepath.Join(t.TempDir(), "other.txt")
+
+	t.Run("no restriction when AllowedUploadRoots is empty", func(t *testing.T) {
+		withAllowedUploadRoots(t, nil)
+		if err := checkUploadRootsAllowed([]string{outside}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("accepts paths under an allowed root", func(t *testing.T) {
+		withAllowedUploadRoots(t, []string{dir})
+		if err := checkUploadRootsAllowed([]string{inside}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("accepts the root itself", func(t *testing.T) {
+		withAllowedUploadRoots(t, []string{dir})
+		if err := checkUploadRootsAllowed([]string{dir}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("rejects paths outside every allowed root", func(t *testing.T) {
+		withAllowedUploadRoots(t, []string{dir})
+		if err := checkUploadRootsAllowed([]string{outside}); err == nil {
+			t.Fatal("expected an error for a path outside the allowed roots")
+		}
+	})
+
+	t.Run("rejects a sibling directory with a matching prefix", func(t *testing.T) {
+		withAllowedUploadRoots(t, []string{dir})
+		if err := checkUploadRootsAllowed([]string{dir + "-evil"}); err == nil {
+			t.Fatal("expected an error for a sibling directory sharing a name prefix")
+		}
+	})
+}
@@ -0,0 +1,412 @@
+/*
+MIT License
+
+Copyright (c) 2022 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Detector recognizes the trigger sequence that starts a trzsz transfer
+// inside a stream of terminal output. Implementations may keep state across
+// calls (e.g. to dedupe unique IDs) but are only ever called serially from
+// the Wrapper's output-processing goroutine.
+type Detector interface {
+	// Detect scans buf, the latest chunk of pty output, for a transfer
+	// trigger. ok is false if none was found.
+	Detect(buf []byte) (mode byte, remoteIsWindows bool, ok bool)
+}
+
+// regexpDetector is the default Detector. It matches the `::TRZSZ:TRANSFER:`
+// trigger sequence emitted by the trz/tsz command line tools.
+type regexpDetector struct {
+	regexp      *regexp.Regexp
+	uniqueIDMap map[string]int
+}
+
+func newRegexpDetector() *regexpDetector {
+	return &regexpDetector{
+		regexp:      regexp.MustCompile("::TRZSZ:TRANSFER:([SRD]):(\\d+\\.\\d+\\.\\d+)(:\\d+)?"),
+		uniqueIDMap: make(map[string]int),
+	}
+}
+
+func (d *regexpDetector) Detect(output []byte) (byte, bool, bool) {
+	if len(output) < 24 {
+		return 0, false, false
+	}
+	idx := bytes.LastIndex(output, []byte("::TRZSZ:TRANSFER:"))
+	if idx < 0 {
+		return 0, false, false
+	}
+	match := d.regexp.FindSubmatch(output[idx:])
+	if len(match) < 2 {
+		return 0, false, false
+	}
+	uniqueID := ""
+	if len(match) > 3 {
+		uniqueID = string(match[3])
+	}
+	if len(uniqueID) >= 8 {
+		if _, ok := d.uniqueIDMap[uniqueID]; ok {
+			return 0, false, false
+		}
+		if len(d.uniqueIDMap) > 100 {
+			m := make(map[string]int)
+			for k, v := range d.uniqueIDMap {
+				if v >= 50 {
+					m[k] = v - 50
+				}
+			}
+			d.uniqueIDMap = m
+		}
+		d.uniqueIDMap[uniqueID] = len(d.uniqueIDMap)
+	}
+	remoteIsWindows := uniqueID == ":1"
+	return match[1][0], remoteIsWindows, true
+}
+
+// Hook lets embedders observe the file transfer lifecycle without forking
+// trzsz-go. All methods are called synchronously from the Wrapper's internal
+// goroutines; an implementation that blocks will stall the wrapped session.
+type Hook interface {
+	// OnTransferStart is called when a transfer trigger has been detected
+	// and a transfer is about to begin.
+	OnTransferStart(mode byte, remoteIsWindows bool)
+	// OnTransferProgress reports how many of the total files in the
+	// transfer have completed so far. It fires once with sent == 0 before
+	// the first file starts and once more with sent == total when the last
+	// one finishes; downloadFiles/uploadFiles don't have visibility into
+	// the underlying transfer's per-byte progress, only into file counts.
+	OnTransferProgress(sent, total int64)
+	// OnTransferEnd is called once the transfer finishes, with a non-nil
+	// err if it failed.
+	OnTransferEnd(err error)
+	// OnDragFiles is called when file(s) are dropped onto the terminal and
+	// drag-file uploads are enabled.
+	OnDragFiles(paths []string)
+}
+
+// NopHook is a Hook whose methods do nothing. Embed it to implement only the
+// callbacks you care about.
+type NopHook struct{}
+
+func (NopHook) OnTransferStart(mode byte, remoteIsWindows bool) {}
+func (NopHook) OnTransferProgress(sent, total int64)            {}
+func (NopHook) OnTransferEnd(err error)                         {}
+func (NopHook) OnDragFiles(paths []string)                      {}
+
+// Option configures a Wrapper built by NewWrapper.
+type Option func(*Wrapper)
+
+// WithStdio overrides the reader/writer pair used for local stdio, which
+// defaults to os.Stdin/os.Stdout. Embedders that don't own the process's
+// real stdio (GUI terminals, SSH multiplexers) should set this.
+func WithStdio(in io.Reader, out io.Writer) Option {
+	return func(w *Wrapper) {
+		w.stdin = in
+		w.stdout = out
+	}
+}
+
+// WithDetector overrides the transfer-trigger detection strategy, which
+// defaults to the `::TRZSZ:TRANSFER:` regexp used by trz/tsz.
+func WithDetector(d Detector) Option {
+	return func(w *Wrapper) { w.detector = d }
+}
+
+// WithHook registers a Hook to observe transfer lifecycle events.
+func WithHook(h Hook) Option {
+	return func(w *Wrapper) { w.hook = h }
+}
+
+// WithDragFile enables uploading file(s) dropped onto the terminal.
+func WithDragFile(enable bool) Option {
+	return func(w *Wrapper) { w.dragFile = enable }
+}
+
+// WithTraceLog enables the trace log for debugging.
+func WithTraceLog(enable bool) Option {
+	return func(w *Wrapper) { w.traceLog = enable }
+}
+
+// Wrapper drives a pty's stdio through the trzsz protocol: it watches for
+// transfer triggers in the pty's output and starts a file transfer when one
+// is found. It is the programmatic entry point for embedding trzsz-go in
+// terminal emulators or SSH multiplexers; TrzszMain is a thin CLI wrapper
+// around it.
+type Wrapper struct {
+	pty      *TrzszPty
+	stdin    io.Reader
+	stdout   io.Writer
+	detector Detector
+	hook     Hook
+	dragFile bool
+	traceLog bool
+
+	transfer     unsafe.Pointer // *TrzszTransfer, accessed atomically
+	interrupting int32
+	skipTrzCmd   int32
+
+	dragMutex  sync.Mutex
+	dragging   int32
+	dragHasDir int32
+	dragFiles  []string
+}
+
+// NewWrapper creates a Wrapper around pty. By default it reads from
+// os.Stdin, writes to os.Stdout, uses the built-in TRZSZ trigger regexp, and
+// has no Hook installed.
+func NewWrapper(pty *TrzszPty, opts ...Option) *Wrapper {
+	w := &Wrapper{
+		pty:      pty,
+		stdin:    os.Stdin,
+		stdout:   os.Stdout,
+		detector: newRegexpDetector(),
+		hook:     NopHook{},
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Run starts wrapping the pty's stdio and handling OS signals in background
+// goroutines, then returns immediately. Callers are expected to wait on the
+// pty themselves (e.g. pty.Wait()).
+func (w *Wrapper) Run() {
+	go w.wrapInput()
+	go w.wrapOutput()
+	go w.handleSignal()
+}
+
+func (w *Wrapper) loadTransfer() *TrzszTransfer {
+	return (*TrzszTransfer)(atomic.LoadPointer(&w.transfer))
+}
+
+func (w *Wrapper) storeTransfer(transfer *TrzszTransfer) {
+	atomic.StorePointer(&w.transfer, unsafe.Pointer(transfer))
+}
+
+func (w *Wrapper) handleTrzsz(mode byte, remoteIsWindows bool) {
+	transfer := NewTransfer(w.pty.Stdin, nil)
+	w.storeTransfer(transfer)
+	defer w.storeTransfer(nil)
+
+	if logger := loadTraceLogger(); logger != nil {
+		logger.addTransferStarted()
+	}
+
+	w.hook.OnTransferStart(mode, remoteIsWindows)
+	var err error
+	defer func() { w.hook.OnTransferEnd(err) }()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewTrzszError(fmt.Sprintf("%v", r), "panic", true)
+			transfer.clientError(err)
+		}
+	}()
+
+	switch mode {
+	case 'S':
+		err = downloadFiles(w, transfer, remoteIsWindows)
+	case 'R':
+		err = uploadFiles(w, transfer, false, remoteIsWindows)
+	case 'D':
+		err = uploadFiles(w, transfer, true, remoteIsWindows)
+	}
+	if err != nil {
+		transfer.clientError(err)
+	}
+}
+
+func (w *Wrapper) resetDragFiles() []string {
+	if atomic.LoadInt32(&w.dragging) == 0 {
+		return nil
+	}
+	w.dragMutex.Lock()
+	defer w.dragMutex.Unlock()
+	atomic.StoreInt32(&w.dragging, 0)
+	atomic.StoreInt32(&w.dragHasDir, 0)
+	dragFiles := w.dragFiles
+	w.dragFiles = nil
+	return dragFiles
+}
+
+func (w *Wrapper) addDragFiles(dragFiles []string, hasDir bool) bool {
+	w.dragMutex.Lock()
+	defer w.dragMutex.Unlock()
+	atomic.StoreInt32(&w.dragging, 1)
+	if hasDir {
+		atomic.StoreInt32(&w.dragHasDir, 1)
+	}
+	if logger := loadTraceLogger(); logger != nil {
+		logger.addFilesDragged(int64(len(dragFiles)))
+	}
+	if w.dragFiles == nil {
+		w.dragFiles = dragFiles
+		w.hook.OnDragFiles(dragFiles)
+		return true
+	}
+	w.dragFiles = append(w.dragFiles, dragFiles...)
+	w.hook.OnDragFiles(w.dragFiles)
+	return false
+}
+
+func (w *Wrapper) uploadDragFiles() {
+	time.Sleep(300 * time.Millisecond)
+	if atomic.LoadInt32(&w.dragging) == 0 {
+		return
+	}
+	atomic.StoreInt32(&w.interrupting, 1)
+	w.pty.Stdin.Write([]byte{0x03})
+	time.Sleep(200 * time.Millisecond)
+	atomic.StoreInt32(&w.interrupting, 0)
+	atomic.StoreInt32(&w.skipTrzCmd, 1)
+	if atomic.LoadInt32(&w.dragHasDir) != 0 {
+		w.pty.Stdin.Write([]byte("trz -d\r"))
+	} else {
+		w.pty.Stdin.Write([]byte("trz\r"))
+	}
+	time.Sleep(time.Second)
+	w.resetDragFiles()
+}
+
+func (w *Wrapper) wrapInput() {
+	buffer := make([]byte, 10240)
+	for {
+		n, err := w.stdin.Read(buffer)
+		if err == io.EOF {
+			if IsWindows() { // ctrl + z
+				n = 1
+				err = nil
+				buffer[0] = 0x1A
+			} else {
+				w.pty.Stdin.Close()
+				break
+			}
+		}
+		if err == nil && n > 0 {
+			buf := buffer[0:n]
+			transfer := w.loadTransfer()
+			if w.traceLog {
+				buf = writeTraceLog(buf, false, transfer != nil)
+			}
+			if transfer != nil {
+				if buf[0] == '\x03' { // `ctrl + c` to stop transferring files
+					transfer.stopTransferringFiles()
+				}
+				continue
+			}
+			if w.dragFile {
+				dragFiles, hasDir, ignore := detectDragFiles(buf)
+				if dragFiles != nil {
+					if w.addDragFiles(dragFiles, hasDir) {
+						go w.uploadDragFiles()
+					}
+					continue
+				}
+				if !ignore {
+					w.resetDragFiles()
+				}
+			}
+			w.pty.Stdin.Write(buf)
+		}
+	}
+}
+
+func (w *Wrapper) wrapOutput() {
+	const bufSize = 10240
+	buffer := make([]byte, bufSize)
+	for {
+		n, err := w.pty.Stdout.Read(buffer)
+		if err == io.EOF {
+			if closer, ok := w.stdout.(io.Closer); ok {
+				closer.Close()
+			}
+			break
+		} else if err == nil && n > 0 {
+			buf := buffer[0:n]
+			transfer := w.loadTransfer()
+			if w.traceLog {
+				buf = writeTraceLog(buf, true, transfer != nil)
+			}
+			if transfer != nil {
+				transfer.addReceivedData(buf)
+				buffer = make([]byte, bufSize)
+				continue
+			}
+			mode, remoteIsWindows, ok := w.detector.Detect(buf)
+			if ok {
+				w.stdout.Write(bytes.Replace(buf, []byte("TRZSZ"), []byte("TRZSZGO"), 1))
+				go w.handleTrzsz(mode, remoteIsWindows)
+				continue
+			}
+			if atomic.LoadInt32(&w.interrupting) != 0 {
+				continue
+			}
+			if atomic.LoadInt32(&w.skipTrzCmd) != 0 {
+				atomic.StoreInt32(&w.skipTrzCmd, 0)
+				output := strings.TrimRight(string(trimVT100(buf)), "\r\n")
+				if output == "trz" || output == "trz -d" {
+					w.stdout.Write([]byte("\r\n"))
+					continue
+				}
+			}
+			w.stdout.Write(buf)
+		}
+	}
+}
+
+func (w *Wrapper) handleSignal() {
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	go func() {
+		<-sigterm
+		w.pty.Terminate()
+	}()
+
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+	go func() {
+		for {
+			<-sigint
+			if transfer := w.loadTransfer(); transfer != nil {
+				transfer.stopTransferringFiles()
+			}
+		}
+	}()
+}
@@ -0,0 +1,166 @@
+/*
+MIT License
+
+Copyright (c) 2022 Lonny Wong
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package trzsz
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRegexpDetectorDetect(t *testing.T) {
+	tests := []struct {
+		name                string
+		buf                 string
+		wantMode            byte
+		wantRemoteIsWindows bool
+		wantOk              bool
+	}{
+		{
+			name:   "too short to contain a trigger",
+			buf:    "::TRZSZ:TRANSFER:S",
+			wantOk: false,
+		},
+		{
+			name:   "no trigger present",
+			buf:    "just some ordinary shell output over 24 bytes long",
+			wantOk: false,
+		},
+		{
+			name:     "download trigger without a unique id",
+			buf:      "::TRZSZ:TRANSFER:S:1.2.3",
+			wantMode: 'S',
+			wantOk:   true,
+		},
+		{
+			name:                "upload trigger with the windows sentinel id",
+			buf:                 "::TRZSZ:TRANSFER:R:1.2.3:1",
+			wantMode:            'R',
+			wantRemoteIsWindows: true,
+			wantOk:              true,
+		},
+		{
+			name:     "drag-upload trigger with a long unique id",
+			buf:      "::TRZSZ:TRANSFER:D:1.2.3:12345678",
+			wantMode: 'D',
+			wantOk:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newRegexpDetector()
+			mode, remoteIsWindows, ok := d.Detect([]byte(tt.buf))
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if mode != tt.wantMode {
+				t.Errorf("mode = %q, want %q", mode, tt.wantMode)
+			}
+			if remoteIsWindows != tt.wantRemoteIsWindows {
+				t.Errorf("remoteIsWindows = %v, want %v", remoteIsWindows, tt.wantRemoteIsWindows)
+			}
+		})
+	}
+}
+
+func TestRegexpDetectorDedupesRepeatedUniqueID(t *testing.T) {
+	d := newRegexpDetector()
+	buf := []byte("::TRZSZ:TRANSFER:S:1.2.3:12345678")
+
+	if _, _, ok := d.Detect(buf); !ok {
+		t.Fatal("first sighting of a unique id should be detected")
+	}
+	if _, _, ok := d.Detect(buf); ok {
+		t.Fatal("repeated sighting of the same unique id should be deduped")
+	}
+}
+
+// TestRegexpDetectorEvictsOldUniqueIDs mirrors the eviction sweep in Detect:
+// once the unique-id map grows past 100 entries, every entry with a value
+// under 50 (i.e. among the oldest ~50 seen) is dropped. A unique id whose
+// entry gets dropped should be detectable again, since dedup has forgotten it.
+func TestRegexpDetectorEvictsOldUniqueIDs(t *testing.T) {
+	d := newRegexpDetector()
+	trigger := func(i int) []byte {
+		return []byte(fmt.Sprintf("::TRZSZ:TRANSFER:S:1.2.3:%08d", i))
+	}
+
+	const total = 102 // enough new ids to push the map past 100 and trigger one eviction sweep
+	for i := 0; i < total; i++ {
+		if _, _, ok := d.Detect(trigger(i)); !ok {
+			t.Fatalf("id %d: expected first sighting to be detected", i)
+		}
+	}
+
+	if _, _, ok := d.Detect(trigger(0)); !ok {
+		t.Fatal("the oldest id should have been evicted and be detectable again")
+	}
+	if _, _, ok := d.Detect(trigger(total - 1)); ok {
+		t.Fatal("the most recently seen id should still be deduped, not evicted")
+	}
+}
+
+type fakeHook struct {
+	NopHook
+	dragCalls [][]string
+}
+
+func (h *fakeHook) OnDragFiles(paths []string) {
+	// Copy since callers may keep mutating their backing slice afterwards.
+	h.dragCalls = append(h.dragCalls, append([]string(nil), paths...))
+}
+
+func TestWrapperAddDragFilesDispatchesHook(t *testing.T) {
+	hook := &fakeHook{}
+	w := &Wrapper{hook: hook}
+
+	first := w.addDragFiles([]string{"a.txt"}, false)
+	if !first {
+		t.Fatal("first addDragFiles call should report itself as the first")
+	}
+	second := w.addDragFiles([]string{"b.txt"}, true)
+	if second {
+		t.Fatal("second addDragFiles call should report itself as a follow-up")
+	}
+
+	want := [][]string{
+		{"a.txt"},
+		{"a.txt", "b.txt"},
+	}
+	if !reflect.DeepEqual(hook.dragCalls, want) {
+		t.Fatalf("OnDragFiles calls = %v, want %v", hook.dragCalls, want)
+	}
+
+	files := w.resetDragFiles()
+	if !reflect.DeepEqual(files, []string{"a.txt", "b.txt"}) {
+		t.Fatalf("resetDragFiles() = %v, want [a.txt b.txt]", files)
+	}
+	if w.resetDragFiles() != nil {
+		t.Fatal("resetDragFiles() after a reset should return nil")
+	}
+}